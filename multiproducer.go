@@ -1,18 +1,33 @@
 package sarama
 
 import (
+	"container/list"
+	"errors"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/eapache/go-resiliency/breaker"
 )
 
+// metadataRefreshCooldown is the minimum time between two metadata refreshes
+// for the same topic; it's jittered per-refresh so a large batch failing
+// against many topics at once doesn't line every retry up into a thundering
+// herd against the controller.
+const metadataRefreshCooldown = 250 * time.Millisecond
+
 type MultiProducerConfig struct {
-	Partitioner        Partitioner
-	RequiredAcks       RequiredAcks
-	Timeout            int32
-	Compression        CompressionCodec
-	MaxBufferBytes     uint32
-	MaxBufferTime      uint32
-	MaxDeliveryRetries uint32
+	Partitioner             Partitioner
+	RequiredAcks            RequiredAcks
+	Timeout                 int32
+	Compression             CompressionCodec
+	MaxBufferBytes          uint32
+	MaxBufferTime           uint32
+	MaxDeliveryRetries      uint32
+	BreakerErrorThreshold   int
+	BreakerSuccessThreshold int
+	BreakerTimeout          time.Duration
 }
 
 type MultiProducer struct {
@@ -23,23 +38,132 @@ type MultiProducer struct {
 	errors          chan error
 	deliveryLocks   map[topicPartition]chan bool
 	dm              sync.RWMutex
+	nextRefreshAt   map[string]time.Time
+	rm              sync.Mutex
 }
 
 type brokerProducer struct {
 	mapM          sync.Mutex
-	messages      map[string]map[int32][]*produceMessage
+	messages      map[string]map[int32]*messageQueue
 	bufferedBytes uint32
 	flushNow      chan bool
 	broker        *Broker
 	stopper       chan bool
 	hasMessages   chan bool
+	cb            *breaker.Breaker
+	probing       int32
+}
+
+// messageQueue is a FIFO of pending messages for a single topic-partition.
+// retryHead holds messages being requeued after a failed delivery attempt;
+// it is always drained ahead of main so retries are redelivered before any
+// message that was merely waiting its turn.
+type messageQueue struct {
+	retryHead *list.List
+	main      *list.List
+}
+
+func newMessageQueue() *messageQueue {
+	return &messageQueue{retryHead: list.New(), main: list.New()}
+}
+
+func (q *messageQueue) push(msg *produceMessage, isRetry bool) {
+	if isRetry {
+		// O(1) push-front; the reverse iteration in the retry callers
+		// restores the original in-order delivery guarantee.
+		q.retryHead.PushFront(msg)
+	} else {
+		q.main.PushBack(msg)
+	}
+}
+
+// drain removes and returns every message currently queued, retryHead first.
+func (q *messageQueue) drain() []*produceMessage {
+	var out []*produceMessage
+	for e := q.retryHead.Front(); e != nil; e = e.Next() {
+		out = append(out, e.Value.(*produceMessage))
+	}
+	q.retryHead.Init()
+	for e := q.main.Front(); e != nil; e = e.Next() {
+		out = append(out, e.Value.(*produceMessage))
+	}
+	q.main.Init()
+	return out
 }
 
 type produceMessage struct {
-	topic      string
-	partition  int32
-	key, value []byte
-	failures   uint32
+	topic          string
+	partition      int32
+	partitionCount int32
+	key, value     []byte
+	failures       uint32
+	promise        *ProduceResult
+}
+
+// ProduceResult is a handle to the outcome of a single message handed to
+// SendMessageAsync. It resolves exactly once, when the message is either
+// delivered or has exhausted its retries.
+type ProduceResult struct {
+	done      chan struct{}
+	err       error
+	partition int32
+	offset    int64
+}
+
+func newProduceResult() *ProduceResult {
+	return &ProduceResult{done: make(chan struct{})}
+}
+
+// Done is closed once the message has reached a terminal state.
+func (r *ProduceResult) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err is the delivery error, or nil on success. Only meaningful after Done is closed.
+func (r *ProduceResult) Err() error {
+	return r.err
+}
+
+// Partition is the partition the message was produced to. Only meaningful after Done is closed.
+func (r *ProduceResult) Partition() int32 {
+	return r.partition
+}
+
+// Offset is the offset assigned by the broker, or -1 if it's unknown (delivery
+// failed, or the broker doesn't return one). Only meaningful after Done is closed.
+func (r *ProduceResult) Offset() int64 {
+	return r.offset
+}
+
+func (r *ProduceResult) resolve(partition int32, offset int64, err error) {
+	r.partition = partition
+	r.offset = offset
+	r.err = err
+	close(r.done)
+}
+
+// resolveDelivered resolves every message in messages belonging to
+// (topic, partition) as successfully delivered, assigning sequential offsets
+// starting at baseOffset in the order they appear in messages. baseOffset is
+// the offset of the first message in the partition's batch, per the Kafka
+// produce response format; later messages in the same batch take the
+// following offsets in order.
+func resolveDelivered(messages []*produceMessage, topic string, partition int32, baseOffset int64) {
+	offset := baseOffset
+	for _, msg := range messages {
+		if msg.topic == topic && msg.partition == partition {
+			msg.promise.resolve(partition, offset, nil)
+			offset++
+		}
+	}
+}
+
+// byteEncoder lets a retry re-run a message's already-encoded key through the
+// Partitioner without holding on to the original Encoder.
+type byteEncoder []byte
+
+func (b byteEncoder) Encode() ([]byte, error) {
+	return []byte(b), nil
 }
 
 type topicPartition struct {
@@ -47,6 +171,11 @@ type topicPartition struct {
 	partition int32
 }
 
+// ErrBreakerOpen is returned (via the Errors() channel, or the synchronous
+// SendMessage return value) for messages that failed because the circuit
+// breaker for their destination broker was open.
+var ErrBreakerOpen = errors.New("sarama: circuit breaker is open for this broker")
+
 func NewMultiProducer(client *Client, config *MultiProducerConfig) (*MultiProducer, error) {
 	if config == nil {
 		config = new(MultiProducerConfig)
@@ -68,12 +197,25 @@ func NewMultiProducer(client *Client, config *MultiProducerConfig) (*MultiProduc
 		config.MaxBufferBytes = 1
 	}
 
+	if config.BreakerErrorThreshold == 0 {
+		config.BreakerErrorThreshold = 10
+	}
+
+	if config.BreakerSuccessThreshold == 0 {
+		config.BreakerSuccessThreshold = 1
+	}
+
+	if config.BreakerTimeout == 0 {
+		config.BreakerTimeout = 10 * time.Second
+	}
+
 	return &MultiProducer{
 		client:          client,
 		config:          *config,
 		errors:          make(chan error, 16),
 		deliveryLocks:   make(map[topicPartition]chan bool),
 		brokerProducers: make(map[*Broker]*brokerProducer),
+		nextRefreshAt:   make(map[string]time.Time),
 	}, nil
 }
 
@@ -89,40 +231,63 @@ func (p *MultiProducer) Close() error {
 	return nil
 }
 
-func (p *MultiProducer) SendMessage(topic string, key, value Encoder) (err error) {
+func (p *MultiProducer) SendMessage(topic string, key, value Encoder) error {
+	result, err := p.SendMessageAsync(topic, key, value)
+	if err != nil {
+		return err
+	}
+
+	if !p.isSynchronous() {
+		return nil
+	}
+
+	<-result.Done()
+	return result.Err()
+}
+
+// SendMessageAsync enqueues a message for delivery and returns immediately
+// with a *ProduceResult that resolves once the message is delivered or has
+// exhausted its retries, regardless of MaxBufferBytes/MaxBufferTime.
+func (p *MultiProducer) SendMessageAsync(topic string, key, value Encoder) (*ProduceResult, error) {
 	var keyBytes, valBytes []byte
+	var err error
 
 	if key != nil {
 		if keyBytes, err = key.Encode(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if value != nil {
 		if valBytes, err = value.Encode(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	partition, err := p.choosePartition(topic, key)
+	partition, numPartitions, err := p.choosePartition(topic, key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	msg := &produceMessage{
-		topic:     topic,
-		partition: partition,
-		key:       keyBytes,
-		value:     valBytes,
-		failures:  0,
+		topic:          topic,
+		partition:      partition,
+		partitionCount: numPartitions,
+		key:            keyBytes,
+		value:          valBytes,
+		promise:        newProduceResult(),
 	}
 
-	return p.addMessage(msg, false)
+	if err := p.addMessage(msg, false); err != nil {
+		return nil, err
+	}
+
+	return msg.promise, nil
 }
 
-func (p *MultiProducer) choosePartition(topic string, key Encoder) (int32, error) {
+func (p *MultiProducer) choosePartition(topic string, key Encoder) (int32, int32, error) {
 	partitions, err := p.client.Partitions(topic)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 
 	numPartitions := int32(len(partitions))
@@ -130,13 +295,19 @@ func (p *MultiProducer) choosePartition(topic string, key Encoder) (int32, error
 	choice := p.config.Partitioner.Partition(key, numPartitions)
 
 	if choice < 0 || choice >= numPartitions {
-		return -1, InvalidPartition
+		return -1, 0, InvalidPartition
 	}
 
-	return partitions[choice], nil
+	return partitions[choice], numPartitions, nil
 }
 
 func (p *MultiProducer) addMessage(msg *produceMessage, isRetry bool) error {
+	if isRetry {
+		// Best effort: if we can't confirm the current partition count, fall
+		// back to the partition the message already has rather than drop it.
+		p.maybeRepartition(msg)
+	}
+
 	broker, err := p.client.Leader(msg.topic, msg.partition)
 	if err != nil {
 		return err
@@ -145,13 +316,90 @@ func (p *MultiProducer) addMessage(msg *produceMessage, isRetry bool) error {
 	bp := p.brokerProducerFor(broker)
 	bp.addMessage(msg, p.config.MaxBufferBytes, isRetry)
 
-	if p.isSynchronous() {
-		return <-p.errors
-	}
 	return nil
 }
 
+// reportError fans a terminal delivery error out to Errors(), for callers
+// still using the shared-channel API instead of per-message promises. It
+// must never block: Errors() panics (and so is never drained) in
+// synchronous mode, and nothing guarantees a reader in asynchronous mode
+// either, so a blocking send here could wedge flushRequest before it ever
+// reaches releaseDeliveryLock/releaseAllLocks.
+func (p *MultiProducer) reportError(err error) {
+	select {
+	case p.errors <- err:
+	default:
+	}
+}
+
+// maybeRepartition re-evaluates a retried message's partition when the
+// topic's partition count has changed since it was last assigned. Leaving it
+// on its old partition index when partitions were added or removed would
+// either strand it against a stale index or break the ordering guarantee the
+// partitioner gives messages sharing a key.
+func (p *MultiProducer) maybeRepartition(msg *produceMessage) {
+	partitions, err := p.client.Partitions(msg.topic)
+	if err != nil {
+		return
+	}
+
+	numPartitions := int32(len(partitions))
+	if numPartitions == msg.partitionCount {
+		return
+	}
+
+	choice := p.config.Partitioner.Partition(keyEncoder(msg.key), numPartitions)
+	if choice < 0 || choice >= numPartitions {
+		return
+	}
+
+	msg.partition = partitions[choice]
+	msg.partitionCount = numPartitions
+}
+
+// keyEncoder returns the Encoder to hand to the Partitioner when
+// repartitioning a retried message: a literal nil for a keyless message, so
+// a nil-aware partitioner (e.g. HashPartitioner falling back to random
+// selection) behaves the same way it did on the original send, or the
+// already-encoded key bytes otherwise.
+func keyEncoder(key []byte) Encoder {
+	if key == nil {
+		return nil
+	}
+	return byteEncoder(key)
+}
+
+// maybeRefreshTopicMetadata asks the client to re-fetch partition and leader
+// metadata for topic, unless a refresh for it already happened too recently.
+// It's called whenever a produce attempt comes back with a retriable,
+// metadata-shaped error so the next retry has a chance of reaching the real
+// leader instead of looping against stale information.
+func (p *MultiProducer) maybeRefreshTopicMetadata(topic string) {
+	p.rm.Lock()
+	now := time.Now()
+	if next, ok := p.nextRefreshAt[topic]; ok && now.Before(next) {
+		p.rm.Unlock()
+		return
+	}
+	jitter := time.Duration(rand.Int63n(int64(metadataRefreshCooldown)))
+	p.nextRefreshAt[topic] = now.Add(metadataRefreshCooldown + jitter)
+	p.rm.Unlock()
+
+	// Best effort; if this fails the next retry will simply hit the same
+	// stale leader again and fall back to the normal retry path.
+	p.client.RefreshMetadata(topic)
+}
+
+// isSynchronous reports whether SendMessage should block on delivery. There is
+// nothing to await when RequiredAcks == 0: the broker never sends a response,
+// so SendMessage returns as soon as the message is queued, without waiting
+// for the write, regardless of how MaxBufferBytes/MaxBufferTime are
+// configured. The write's outcome is reported through the ProduceResult from
+// SendMessageAsync and through Errors().
 func (p *MultiProducer) isSynchronous() bool {
+	if p.config.RequiredAcks == 0 {
+		return false
+	}
 	return p.config.MaxBufferBytes < 2 && p.config.MaxBufferTime == 0
 }
 
@@ -173,11 +421,12 @@ func (p *MultiProducer) brokerProducerFor(broker *Broker) *brokerProducer {
 
 func (p *MultiProducer) newBrokerProducer(broker *Broker) *brokerProducer {
 	bp := &brokerProducer{
-		messages:    make(map[string]map[int32][]*produceMessage),
+		messages:    make(map[string]map[int32]*messageQueue),
 		flushNow:    make(chan bool, 1),
 		broker:      broker,
 		stopper:     make(chan bool),
 		hasMessages: make(chan bool, 1),
+		cb:          breaker.New(p.config.BreakerErrorThreshold, p.config.BreakerSuccessThreshold, p.config.BreakerTimeout),
 	}
 
 	maxBufferTime := time.Duration(p.config.MaxBufferTime) * time.Millisecond
@@ -216,16 +465,15 @@ func (bp *brokerProducer) addMessage(msg *produceMessage, maxBufferBytes uint32,
 	bp.mapM.Lock()
 	forTopic, ok := bp.messages[msg.topic]
 	if !ok {
-		forTopic = make(map[int32][]*produceMessage)
+		forTopic = make(map[int32]*messageQueue)
 		bp.messages[msg.topic] = forTopic
 	}
-	if isRetry {
-		// Prepend: Deliver first.
-		forTopic[msg.partition] = append([]*produceMessage{msg}, forTopic[msg.partition]...)
-	} else {
-		// Append
-		forTopic[msg.partition] = append(forTopic[msg.partition], msg)
+	q, ok := forTopic[msg.partition]
+	if !ok {
+		q = newMessageQueue()
+		forTopic[msg.partition] = q
 	}
+	q.push(msg, isRetry)
 	bp.bufferedBytes += uint32(len(msg.key) + len(msg.value))
 
 	select {
@@ -256,11 +504,10 @@ func (bp *brokerProducer) flush(p *MultiProducer) {
 
 	bp.mapM.Lock()
 	for topic, m := range bp.messages {
-		for partition, messages := range m {
+		for partition, q := range m {
 			if p.tryAcquireDeliveryLock(topic, partition) {
 
-				messagesToSend = append(messagesToSend, messages...)
-				m[partition] = nil
+				messagesToSend = append(messagesToSend, q.drain()...)
 
 			}
 		}
@@ -289,27 +536,91 @@ func (bp *brokerProducer) Close() error {
 	return nil
 }
 
+// scheduleBreakerProbe kicks a flush shortly after the breaker's timeout so a
+// half-open probe goes out as soon as the breaker allows it, rather than
+// waiting on the next buffered message or flush tick. It's a no-op if a probe
+// is already scheduled.
+func (bp *brokerProducer) scheduleBreakerProbe(p *MultiProducer) {
+	if !atomic.CompareAndSwapInt32(&bp.probing, 0, 1) {
+		return
+	}
+	go func() {
+		time.Sleep(p.config.BreakerTimeout)
+		atomic.StoreInt32(&bp.probing, 0)
+		bp.tryFlush()
+	}()
+}
+
 func (bp *brokerProducer) flushRequest(p *MultiProducer, request *ProduceRequest, messages []*produceMessage) {
-	response, err := bp.broker.Produce(p.client.id, request)
+	var response *ProduceResponse
+
+	var produceErr error
+	cbErr := bp.cb.Run(func() (err error) {
+		response, err = bp.broker.Produce(p.client.id, request)
+		produceErr = err
+		if err == EncodingError {
+			// A malformed/oversized message is a client-side problem, not a
+			// sign the broker is unhealthy; don't let it count toward the
+			// breaker's failure threshold.
+			return nil
+		}
+		return err
+	})
+	if produceErr == EncodingError {
+		cbErr = EncodingError
+	}
 
-	switch err {
+	switch cbErr {
 	case nil:
 		break
+	case breaker.ErrBreakerOpen:
+		// The breaker is open, so nothing was sent. Keep this bp (and its
+		// breaker) alive, apply the same retry accounting as a network error
+		// and let the breaker's own timeout decide when to let a probe
+		// request through.
+		for i := len(messages) - 1; i >= 0; i-- {
+			msg := messages[i]
+			if msg.failures < p.config.MaxDeliveryRetries {
+				msg.failures++
+				p.addMessage(msg, true)
+			} else {
+				msg.promise.resolve(msg.partition, -1, ErrBreakerOpen)
+				p.reportError(ErrBreakerOpen)
+			}
+		}
+		bp.scheduleBreakerProbe(p)
+		goto releaseAllLocks
 	case EncodingError:
 		// No sense in retrying; it'll just fail again. But what about all the other
 		// messages that weren't invalid? Really, this is a "shit's broke real good"
 		// scenario, so angrily logging it and moving on is probably acceptable.
-		p.errors <- err
+		for _, msg := range messages {
+			msg.promise.resolve(msg.partition, -1, cbErr)
+		}
+		p.reportError(cbErr)
 		goto releaseAllLocks
 	default:
 		// TODO: Now we have to sift through the messages and determine which should be retried.
 
-		p.client.disconnectBroker(bp.broker)
-		bp.Close()
+		// A plain transport error counts against the breaker; once the error
+		// threshold is reached the breaker opens and later flushes take the
+		// breaker.ErrBreakerOpen case above. Keep this same
+		// bp (and its breaker) alive across failures so the threshold can
+		// accumulate instead of being reset to zero on every retry cycle.
+
+		// A network error means our metadata for every topic in this batch
+		// could be pointing at a dead leader; kick off a refresh per topic
+		// (deduplicated and cooled down) before the retries below re-resolve
+		// the leader for each message.
+		refreshed := make(map[string]bool)
 
 		// ie. for msg := range reverse(messages)
 		for i := len(messages) - 1; i >= 0; i-- {
 			msg := messages[i]
+			if !refreshed[msg.topic] {
+				p.maybeRefreshTopicMetadata(msg.topic)
+				refreshed[msg.topic] = true
+			}
 			if msg.failures < p.config.MaxDeliveryRetries {
 				msg.failures++
 				// Passing isRetry=true causes the message to happen before other queued messages.
@@ -317,16 +628,33 @@ func (bp *brokerProducer) flushRequest(p *MultiProducer, request *ProduceRequest
 				// to preserve ordering, we have to prepend the items starting from the last one.
 				p.addMessage(msg, true)
 			} else {
-				// log about message failing too many times?
+				msg.promise.resolve(msg.partition, -1, cbErr)
+				p.reportError(cbErr)
 			}
 		}
 		goto releaseAllLocks
 	}
 
-	// When does this ever actually happen, and why don't we explode when it does?
-	// This seems bad.
+	if p.config.RequiredAcks == 0 {
+		// The broker sends no response in this mode, so there's nothing to
+		// parse: the write having reached the socket without cbErr is all the
+		// confirmation we'll ever get. Socket-level failures are still caught
+		// above, by the breaker/EncodingError/default cases, and reported
+		// through the usual promise/Errors() paths even though the produce
+		// itself goes unacked.
+		for _, msg := range messages {
+			msg.promise.resolve(msg.partition, -1, nil)
+		}
+		goto releaseAllLocks
+	}
+
+	// The broker only omits a response when RequiredAcks == 0, which is
+	// handled above; anything else landing here is an anomaly rather than
+	// the expected fire-and-forget path.
 	if response == nil {
-		p.errors <- nil
+		for _, msg := range messages {
+			msg.promise.resolve(msg.partition, -1, nil)
+		}
 		goto releaseAllLocks
 	}
 
@@ -340,10 +668,12 @@ func (bp *brokerProducer) flushRequest(p *MultiProducer, request *ProduceRequest
 			switch block.Err {
 			case NoError:
 				// All the messages for this topic-partition were delivered successfully!
-				// Unlock delivery for this topic-partition and discard the produceMessage objects.
-				p.errors <- nil
+				// block.Offset is only the offset of the first message in the
+				// batch; resolve the rest with their position added on top, then
+				// unlock delivery for this topic-partition.
+				resolveDelivered(messages, topic, partition, block.Offset)
 			case UnknownTopicOrPartition, NotLeaderForPartition, LeaderNotAvailable:
-				// TODO: should we refresh metadata for this topic?
+				p.maybeRefreshTopicMetadata(topic)
 
 				// ie. for msg := range reverse(messages)
 				for i := len(messages) - 1; i >= 0; i-- {
@@ -356,12 +686,19 @@ func (bp *brokerProducer) flushRequest(p *MultiProducer, request *ProduceRequest
 							// to preserve ordering, we have to prepend the items starting from the last one.
 							p.addMessage(msg, true)
 						} else {
-							// dropping message; log angrily maybe.
+							msg.promise.resolve(partition, -1, block.Err)
+							p.reportError(block.Err)
 						}
 					}
 				}
 			default:
-				// non-retriable error. Drop the messages and log angrily.
+				// non-retriable error. Resolve and drop the messages.
+				for _, msg := range messages {
+					if msg.topic == topic && msg.partition == partition {
+						msg.promise.resolve(partition, -1, block.Err)
+						p.reportError(block.Err)
+					}
+				}
 			}
 			p.releaseDeliveryLock(topic, partition)
 		}